@@ -0,0 +1,358 @@
+// Copyright 2021 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package driver implements a small analog of the "Shell" abstraction
+// used internally by the Go build system (cmd/go/internal/work): a
+// tree-structured context for running commands against an artifact
+// directory, with a thread-safe printer and a cache of directories
+// already created, so that capture-extlink's various features
+// (object dumps, DWARF dumps, buildmode/target sweeps) can share one
+// implementation of "run this command and record what happened"
+// instead of each growing its own ad-hoc exec.Command wrapping.
+package driver
+
+import (
+	"bytes"
+	"debug/dwarf"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Driver owns an artifact directory, an environment to run commands
+// in, and a log of the commands it has run. A Driver may be branched
+// with WithEnv to scope additional environment (e.g. GOOS/GOARCH) to
+// one part of a sweep; branches share their root's artifact dir,
+// printer, command log, and directory cache, so concurrent branches
+// (one per goroutine in a parallel target sweep) don't race on any
+// of them.
+type Driver struct {
+	root    string // artifact directory this Driver (and its branches) is rooted at
+	env     []string
+	verbose int
+
+	mu     *sync.Mutex // serializes writes to logw and stderr trace output
+	logw   *os.File
+	mkdirs *sync.Map // dir -> error, so repeated MkdirAll calls are cheap and race-free
+}
+
+// New creates a Driver rooted at dir, creating dir if it does not
+// already exist. Callers that don't care where artifacts land can
+// pass "" to root the Driver at os.TempDir() itself.
+func New(dir string) (*Driver, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, fmt.Errorf("creating artifact dir %s: %v", dir, err)
+	}
+	logw, err := os.OpenFile(filepath.Join(dir, "commands.log"),
+		os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("opening command log in %s: %v", dir, err)
+	}
+	return &Driver{
+		root:   dir,
+		mu:     &sync.Mutex{},
+		logw:   logw,
+		mkdirs: &sync.Map{},
+	}, nil
+}
+
+// SetVerbose sets the trace level; Run/RunOut echo the commands they
+// execute to stderr when it is non-zero.
+func (d *Driver) SetVerbose(v int) { d.verbose = v }
+
+// WithEnv returns a branch of d that runs commands with env appended
+// on top of d's own environment. The branch shares d's artifact dir,
+// printer, command log and mkdir cache.
+func (d *Driver) WithEnv(env ...string) *Driver {
+	branch := *d
+	branch.env = append(append([]string{}, d.env...), env...)
+	return &branch
+}
+
+// Root is the artifact directory this Driver is rooted at.
+func (d *Driver) Root() string { return d.root }
+
+// Dir joins elem onto the artifact root and ensures the result
+// exists, creating it (and any parents) if necessary.
+func (d *Driver) Dir(elem ...string) (string, error) {
+	dir := filepath.Join(append([]string{d.root}, elem...)...)
+	if err := d.Mkdir(dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// Mkdir creates dir (and any parents) if it hasn't already been
+// created by this Driver tree. Safe to call concurrently from
+// branches sharing the same root.
+func (d *Driver) Mkdir(dir string) error {
+	if cached, ok := d.mkdirs.Load(dir); ok {
+		if cached == nil {
+			return nil
+		}
+		return cached.(error)
+	}
+	err := os.MkdirAll(dir, 0777)
+	d.mkdirs.Store(dir, err)
+	return err
+}
+
+// log records a command (and its outcome) in the shared command log
+// and, at high enough verbosity, echoes it to stderr. Safe for
+// concurrent use across branches of the same tree.
+func (d *Driver) log(desc string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fmt.Fprintln(d.logw, desc)
+	if d.verbose > 0 {
+		fmt.Fprintln(os.Stderr, desc)
+	}
+}
+
+// Run runs cmd with the Driver's environment, returning an error
+// rather than aborting the process if it exits non-zero -- callers
+// that want the old fatal-on-failure behavior should do that
+// themselves, since a sweep over many targets/buildmodes wants to
+// keep going on a single failure.
+func (d *Driver) Run(cmd []string) error {
+	return d.RunIn("", cmd)
+}
+
+// RunIn is like Run but runs cmd with its working directory set to
+// dir (the caller's cwd if dir is "").
+func (d *Driver) RunIn(dir string, cmd []string) error {
+	d.log("run: " + strings.Join(cmd, " "))
+	c := exec.Command(cmd[0], cmd[1:]...)
+	c.Dir = dir
+	if len(d.env) > 0 {
+		c.Env = append(os.Environ(), d.env...)
+	}
+	b, err := c.CombinedOutput()
+	if err != nil {
+		d.log(fmt.Sprintf("run: %s failed: %v\n%s", strings.Join(cmd, " "), err, b))
+	}
+	return err
+}
+
+// RunOut runs cmd with the Driver's environment, writing its
+// combined stdout/stderr to outfile.
+func (d *Driver) RunOut(cmd []string, outfile string) error {
+	d.log(fmt.Sprintf("run: %s > %s", strings.Join(cmd, " "), outfile))
+	of, err := os.OpenFile(outfile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("opening output file %s: %v", outfile, err)
+	}
+	defer of.Close()
+	c := exec.Command(cmd[0], cmd[1:]...)
+	if len(d.env) > 0 {
+		c.Env = append(os.Environ(), d.env...)
+	}
+	c.Stdout = of
+	c.Stderr = of
+	return c.Run()
+}
+
+// CopyArtifact copies the file at from to to, creating to's parent
+// directory if needed.
+func (d *Driver) CopyArtifact(from, to string) error {
+	if err := d.Mkdir(filepath.Dir(to)); err != nil {
+		return err
+	}
+	input, err := ioutil.ReadFile(from)
+	if err != nil {
+		return fmt.Errorf("copying %s: readfile: %v", from, err)
+	}
+	if err := ioutil.WriteFile(to, input, 0644); err != nil {
+		return fmt.Errorf("copying %s: writefile %s: %v", from, to, err)
+	}
+	return nil
+}
+
+// DumpObject writes an "objdump -t" listing of the object at path to
+// destdir/<base>.od.txt, picking the right objdump flavor depending
+// on whether path looks like a Go object (magic contains
+// "go object ") or a host object, and alongside it a
+// destdir/<base>.dwarf.txt dump of whatever DWARF the object
+// carries, if any.
+func (d *Driver) DumpObject(path, destdir string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading object file %s: %v", path, err)
+	}
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	odout := filepath.Join(destdir, base+".od.txt")
+	dwout := filepath.Join(destdir, base+".dwarf.txt")
+	isGoObj := bytes.Contains(b, []byte("go object "))
+
+	// The objdump and DWARF dump are independent outputs -- run both
+	// and log each failure separately rather than letting one gate
+	// the other, since e.g. plain "objdump -t" doesn't recognize
+	// Go's native object format but that has no bearing on whether
+	// a DWARF dump can still be produced.
+	var odErr, dwErr error
+	if isGoObj {
+		// Plain "objdump -t" doesn't recognize Go's native
+		// intermediate object format, so use "go tool objdump"
+		// instead; "-gnu" also annotates the disassembly with the
+		// DWARF-derived file/line info, since these objects don't
+		// expose their DWARF via debug/elf et al.
+		odErr = d.RunOut([]string{"go", "tool", "objdump", path}, odout)
+		dwErr = d.RunOut([]string{"go", "tool", "objdump", "-gnu", path}, dwout)
+	} else {
+		odErr = d.RunOut([]string{"objdump", "-t", path}, odout)
+		if dw, err := openDwarf(path); err == nil {
+			dwErr = dumpDwarfSections(dw, dwout)
+		}
+		// openDwarf failing just means this object has no DWARF;
+		// nothing more to do.
+	}
+	if odErr != nil {
+		d.log(fmt.Sprintf("objdump of %s failed: %v", path, odErr))
+	}
+	if dwErr != nil {
+		d.log(fmt.Sprintf("dwarf dump of %s failed: %v", path, dwErr))
+	}
+	if odErr != nil {
+		return odErr
+	}
+	return dwErr
+}
+
+// openDwarf tries each of the object file formats the standard
+// library knows how to parse (ELF, Mach-O, PE) in turn and returns
+// the DWARF data for whichever one succeeds.
+func openDwarf(path string) (*dwarf.Data, error) {
+	if ef, err := elf.Open(path); err == nil {
+		defer ef.Close()
+		return ef.DWARF()
+	}
+	if mf, err := macho.Open(path); err == nil {
+		defer mf.Close()
+		return mf.DWARF()
+	}
+	if pf, err := pe.Open(path); err == nil {
+		defer pf.Close()
+		return pf.DWARF()
+	}
+	return nil, fmt.Errorf("unrecognized object file format")
+}
+
+// dumpDwarfSections walks the compile units in d, emitting a
+// human-readable rendering of .debug_info (DIEs and their
+// attributes, printed as raw Go values -- loc/ranges attributes show
+// up as unresolved offsets or byte blobs rather than decoded
+// locations) and, for each compile unit, the associated .debug_line
+// table. debug/dwarf exposes no .debug_frame/CFI reader, so
+// call-frame information is never dumped.
+func dumpDwarfSections(d *dwarf.Data, outfile string) error {
+	of, err := os.OpenFile(outfile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("opening dwarf dump file %s: %v", outfile, err)
+	}
+	defer of.Close()
+
+	r := d.Reader()
+	for {
+		entry, err := r.Next()
+		if err != nil {
+			return fmt.Errorf("reading dwarf entry: %v", err)
+		}
+		if entry == nil {
+			break
+		}
+		fmt.Fprintf(of, "%d: %s\n", entry.Offset, entry.Tag)
+		for _, f := range entry.Field {
+			fmt.Fprintf(of, "\t%s: %v\n", f.Attr, f.Val)
+		}
+		if entry.Tag != dwarf.TagCompileUnit {
+			continue
+		}
+		lr, err := d.LineReader(entry)
+		if err != nil {
+			fmt.Fprintf(of, "\t(error reading line table: %v)\n", err)
+			continue
+		}
+		if lr == nil {
+			continue
+		}
+		var le dwarf.LineEntry
+		for {
+			if err := lr.Next(&le); err != nil {
+				break
+			}
+			fmt.Fprintf(of, "\tline: %s:%d addr=0x%x stmt=%v\n",
+				le.File.Name, le.Line, le.Address, le.IsStmt)
+		}
+	}
+	return nil
+}
+
+// DumpDwarf writes a human-readable dump of the DWARF data in the
+// object at path to outfile, if any is present. It differs from
+// DumpObject in that it writes a single file at the exact path
+// given, rather than deriving destdir/<base>.{od,dwarf}.txt names --
+// useful for one-off dumps like the final linked executable, which
+// doesn't otherwise go through DumpObject.
+func (d *Driver) DumpDwarf(path, outfile string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading object file %s: %v", path, err)
+	}
+	if bytes.Contains(b, []byte("go object ")) {
+		return d.RunOut([]string{"go", "tool", "objdump", "-gnu", path}, outfile)
+	}
+	dw, err := openDwarf(path)
+	if err != nil {
+		return nil
+	}
+	return dumpDwarfSections(dw, outfile)
+}
+
+// BuildWorkdir removes and recreates a directory under the Driver's
+// root and returns it for use as GOTMPDIR. After a build run with
+// "-work" and GOTMPDIR set to this directory, the actual per-build
+// WORK directory can be found with Workdir instead of scraping
+// "WORK=" out of the build's transcript -- which doesn't always
+// appear (e.g. some "go test" invocations) and breaks when parsed
+// out of interleaved, concurrently-produced output. The directory is
+// always wiped first (rather than going through the Mkdir cache),
+// since "-work" deliberately leaves the previous build's WORK dir
+// behind, and a second invocation reusing the same artifact root
+// would otherwise find it alongside the new one.
+func (d *Driver) BuildWorkdir(name string) (string, error) {
+	dir := filepath.Join(d.root, "gotmpdir-"+name)
+	if err := os.RemoveAll(dir); err != nil {
+		return "", fmt.Errorf("removing stale GOTMPDIR %s: %v", dir, err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", fmt.Errorf("creating GOTMPDIR %s: %v", dir, err)
+	}
+	d.mkdirs.Store(dir, error(nil))
+	return dir, nil
+}
+
+// Workdir finds the WORK directory the Go build driver created
+// inside gotmpdir (a directory previously returned by BuildWorkdir
+// and passed to the build as GOTMPDIR). It is an error for gotmpdir
+// to contain anything other than exactly one entry.
+func Workdir(gotmpdir string) (string, error) {
+	entries, err := ioutil.ReadDir(gotmpdir)
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %v", gotmpdir, err)
+	}
+	if len(entries) != 1 {
+		return "", fmt.Errorf("expected exactly one entry in %s, found %d", gotmpdir, len(entries))
+	}
+	return filepath.Join(gotmpdir, entries[0].Name()), nil
+}
@@ -6,20 +6,31 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
+
+	"github.com/thanm/capture-extlink/internal/driver"
 )
 
 var verbflag = flag.Int("v", 0, "Verbose trace output level")
 var tagflag = flag.String("tag", "", "Tag to use for artifact dir")
+var outdirflag = flag.String("o", "", "Artifact directory (default: a tag-named directory under os.TempDir())")
+var buildmodesflag = flag.String("buildmodes", "exe", "Comma-separated list of -buildmode values to capture artifacts for")
+var targetsflag = flag.String("targets", runtime.GOOS+"/"+runtime.GOARCH, "Comma-separated list of goos/goarch targets to capture artifacts for")
+var shardflag = flag.Int("shard", 0, "Shard index (0-based) of the target list to process")
+var shardsflag = flag.Int("shards", 1, "Number of shards to split the target list into")
+var jflag = flag.Int("j", 1, "Number of targets to capture in parallel")
 
 func verb(vlevel int, s string, a ...interface{}) {
 	if *verbflag >= vlevel {
@@ -48,32 +59,96 @@ func usage(msg string) {
 	os.Exit(2)
 }
 
-func docmd(cmd []string) {
-	verb(1, "docmd: %s", strings.Join(cmd, " "))
-	c := exec.Command(cmd[0], cmd[1:]...)
-	b, err := c.CombinedOutput()
-	if err != nil {
-		fatal("error executing cmd %s: %v",
-			strings.Join(cmd, " "), err)
+// target is one GOOS/GOARCH pair to capture artifacts for.
+type target struct {
+	goos   string
+	goarch string
+}
+
+func (t target) String() string { return t.goos + "/" + t.goarch }
+
+// dir is the per-target subdirectory name under the artifact root.
+func (t target) dir() string { return t.goos + "_" + t.goarch }
+
+// env returns the GOOS/GOARCH/CGO_ENABLED overrides for building
+// this target. Cgo is only left enabled for the native target, since
+// cross-compiling generally has no working C toolchain available.
+func (t target) env() []string {
+	cgo := "0"
+	if t.goos == runtime.GOOS && t.goarch == runtime.GOARCH {
+		cgo = "1"
+	}
+	return []string{
+		"GOOS=" + t.goos,
+		"GOARCH=" + t.goarch,
+		"CGO_ENABLED=" + cgo,
 	}
-	os.Stderr.Write(b)
 }
 
-func docmdout(cmd []string, outfile string) {
-	verb(1, "docmdout: %s > %s", strings.Join(cmd, " "), outfile)
-	of, err := os.OpenFile(outfile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		fatal("opening tmp outputfile %s: %v", outfile, err)
+// parseTargets parses a comma-separated "goos/goarch,..." list as
+// accepted by the -targets flag.
+func parseTargets(csv string) []target {
+	var targets []target
+	for _, s := range strings.Split(csv, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		chunks := strings.Split(s, "/")
+		if len(chunks) != 2 {
+			fatal("malformed -targets entry %q, want goos/goarch", s)
+		}
+		targets = append(targets, target{goos: chunks[0], goarch: chunks[1]})
 	}
-	c := exec.Command(cmd[0], cmd[1:]...)
-	c.Stdout = of
-	c.Stderr = of
-	err = c.Run()
-	of.Close()
+	return targets
+}
+
+// manifestEntry records the outcome of capturing one target/buildmode
+// combination, for the top-level manifest.json index.
+type manifestEntry struct {
+	Target    string            `json:"target"`
+	Buildmode string            `json:"buildmode"`
+	Exefile   string            `json:"exefile"`
+	Errfile   string            `json:"errfile"`
+	Workdir   string            `json:"workdir"`
+	BuildOK   bool              `json:"build_ok"`
+	Files     map[string]string `json:"files"` // artifact-relative path -> sha256
+}
+
+// sha256File returns the hex-encoded SHA-256 digest of path.
+func sha256File(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
 	if err != nil {
-		fatal("error executing cmd %s: %v",
-			strings.Join(cmd, " "), err)
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// hashArtifacts walks artdir and returns a map from path (relative
+// to artdir) to SHA-256 digest for every regular file found.
+func hashArtifacts(artdir string) map[string]string {
+	sums := make(map[string]string)
+	visitor := func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		sum, err := sha256File(path)
+		if err != nil {
+			warn("hashing %s: %v", path, err)
+			return nil
+		}
+		rel, err := filepath.Rel(artdir, path)
+		if err != nil {
+			rel = path
+		}
+		sums[rel] = sum
+		return nil
 	}
+	if err := filepath.Walk(artdir, visitor); err != nil {
+		warn("walking %s for hashing: %v", artdir, err)
+	}
+	return sums
 }
 
 func findldflags(cmd []string) (int, string) {
@@ -86,36 +161,63 @@ func findldflags(cmd []string) (int, string) {
 	return -1, ""
 }
 
-func dumpObject(path string, outfile string) {
-	// Is this a Go object or a host/syso object?
-	b, err := ioutil.ReadFile(path)
-	if err != nil {
-		fatal("reading object file %s failed: %v", path, err)
-	}
-	if !bytes.Contains(b, []byte("go object ")) {
-		docmdout([]string{"go", "tool", "objdump", path}, outfile)
-	} else {
-		docmdout([]string{"objdump", "-t", path}, outfile)
+// modeOutputExt returns the file extension go build expects on the
+// -o argument for the given -buildmode value (it rejects mismatched
+// extensions for several of these).
+func modeOutputExt(mode string) string {
+	switch mode {
+	case "c-archive":
+		return "a"
+	case "c-shared", "shared", "plugin":
+		return "so"
+	default:
+		return "exe"
 	}
 }
 
-func perform(cmd []string) {
+// perform runs the given "go build"/"go test" command for target
+// under buildmode, capturing its artifacts via d into
+// d.Root()/<goos>_<goarch>/<buildmode>. It returns a manifestEntry
+// describing the outcome; a failed build is reported there rather
+// than fataling, so that a sweep over many targets/buildmodes can
+// keep going.
+func perform(cmd []string, d *driver.Driver, t target, mode string) manifestEntry {
 	// Remove and recreate artifact dir
-	artdir := fmt.Sprintf("/tmp/xxx.%s", *tagflag)
+	artdir := filepath.Join(d.Root(), t.dir(), mode)
 	verb(1, "recreating artifact dir %s", artdir)
 	if err := os.RemoveAll(artdir); err != nil {
 		fatal("can't remove %s: %v", artdir, err)
 	}
-	if err := os.Mkdir(artdir, 0777); err != nil {
+	if _, err := d.Dir(t.dir(), mode); err != nil {
 		fatal("can't create %s: %v", artdir, err)
 	}
 
-	// Cache clean
-	docmd([]string{"go", "clean", "-cache"})
+	entry := manifestEntry{Target: t.String(), Buildmode: mode}
+
+	// Pre-create a GOTMPDIR private to this target/buildmode, so
+	// that the build's WORK dir (created under it once "-work" is
+	// passed below) can be found by listing this directory rather
+	// than scraping "WORK=" out of the build's transcript -- which
+	// doesn't always appear on its own line (some "go test" runs)
+	// and isn't meaningful to parse out of several builds' output
+	// interleaved by a parallel sweep.
+	gotmpdir, err := d.BuildWorkdir(t.dir() + "-" + mode)
+	if err != nil {
+		fatal("can't create GOTMPDIR %s: %v", gotmpdir, err)
+	}
+
+	gocache := filepath.Join(artdir, "cache-"+t.dir())
+	td := d.WithEnv(append(t.env(), "GOTMPDIR="+gotmpdir, "GOCACHE="+gocache)...)
+	td.SetVerbose(*verbflag)
+	if err := td.Run([]string{"go", "clean", "-cache"}); err != nil {
+		fatal("go clean -cache: %v", err)
+	}
 
 	// Construct rebuild cmd.
-	exefile := fmt.Sprintf("%s/%s.exe", artdir, *tagflag)
-	rcmd := []string{cmd[0], cmd[1], "-x", "-work", "-i", "-o", exefile}
+	exefile := fmt.Sprintf("%s/%s.%s", artdir, *tagflag, modeOutputExt(mode))
+	entry.Exefile = exefile
+	rcmd := []string{cmd[0], cmd[1], "-x", "-work", "-i", "-o", exefile,
+		fmt.Sprintf("-buildmode=%s", mode)}
 	if slot, arg := findldflags(cmd); slot != -1 {
 		cmd[slot] = fmt.Sprintf("-ldflags=-tmpdir=%s %s", artdir, arg)
 	} else {
@@ -125,35 +227,25 @@ func perform(cmd []string) {
 
 	// Now run build.
 	errfile := fmt.Sprintf("%s/err.%s.txt", artdir, *tagflag)
-	f, err := os.OpenFile(errfile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
-		fatal("opening output file %s for build: %v", errfile, err)
-	}
-	verb(1, "cmd is: %s", strings.Join(rcmd, " "))
-	ec := exec.Command(rcmd[0], rcmd[1:]...)
-	ec.Stdout = f
-	ec.Stderr = f
-	ec.Run()
-	verb(1, "build/test complete, output in %s", errfile)
-
-	// Open and examine the build transcript, so as to pick out
-	// the work dir.
-	ef, err := os.Open(errfile)
+	entry.Errfile = errfile
+	buildErr := td.RunOut(rcmd, errfile)
+	entry.BuildOK = buildErr == nil
+	verb(1, "build/test complete (ok=%v), output in %s", entry.BuildOK, errfile)
+
+	wd, err := driver.Workdir(gotmpdir)
 	if err != nil {
-		fatal("opening %s: %v", errfile, err)
-	}
-	wd := ""
-	scanner := bufio.NewScanner(ef)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "WORK=") {
-			chunks := strings.Split(line, "=")
-			wd = chunks[1]
-		}
+		verb(1, "no workdir found under %s: %v", gotmpdir, err)
+		wd = ""
 	}
-	ef.Close()
+	entry.Workdir = wd
 	verb(1, "workdir is: %s", wd)
 
+	if wd == "" {
+		// No point walking a workdir that was never created.
+		entry.Files = hashArtifacts(artdir)
+		return entry
+	}
+
 	files := make(map[string]bool)
 	visitor := func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -165,7 +257,8 @@ func perform(cmd []string) {
 		}
 		n := info.Name()
 		if strings.HasSuffix(n, ".go") || strings.HasSuffix(n, ".c") ||
-			strings.HasSuffix(n, ".h") || strings.HasSuffix(n, ".o") {
+			strings.HasSuffix(n, ".h") || strings.HasSuffix(n, ".o") ||
+			strings.HasSuffix(n, ".a") {
 			files[path] = true
 		}
 		return nil
@@ -173,8 +266,7 @@ func perform(cmd []string) {
 
 	// Explore the workdir and pick out files to copy into the
 	// artifact dir.
-	err = filepath.Walk(wd, visitor)
-	if err != nil {
+	if err := filepath.Walk(wd, visitor); err != nil {
 		fatal("%v", err)
 	}
 	paths := []string{}
@@ -188,9 +280,14 @@ func perform(cmd []string) {
 		chunks := strings.Split(path, "/")
 		verb(1, "path %v", chunks)
 		destdir := filepath.Join(artdir, chunks[len(chunks)-2])
-		os.MkdirAll(destdir, 0777)
 		destfile := filepath.Join(destdir, chunks[len(chunks)-1])
-		copyfile(path, destfile)
+		if err := d.CopyArtifact(path, destfile); err != nil {
+			warn("copying %s: %v", path, err)
+			continue
+		}
+		if strings.HasSuffix(destfile, ".a") {
+			unpackArchive(d, destfile)
+		}
 	}
 
 	dumpvisitor := func(path string, info os.FileInfo, err error) error {
@@ -201,30 +298,134 @@ func perform(cmd []string) {
 		if info.IsDir() {
 			return nil
 		}
-		n := info.Name()
-		if strings.HasSuffix(n, ".o") {
-			odout := path[:len(path)-2] + ".od.txt"
-			docmdout([]string{"objdump", "-t", path}, odout)
+		if strings.HasSuffix(info.Name(), ".o") {
+			if err := d.DumpObject(path, filepath.Dir(path)); err != nil {
+				warn("dumping %s: %v", path, err)
+			}
 		}
 		return nil
 	}
 	// Now that we've copied in objects from the workdir, run
-	// "objdump -t" on all objects in the artifact dir.
-	err = filepath.Walk(artdir, dumpvisitor)
-	if err != nil {
+	// "objdump -t" on all objects in the artifact dir, plus a
+	// DWARF dump so that intermediate-object DWARF can be diffed
+	// across toolchain revisions.
+	if err := filepath.Walk(artdir, dumpvisitor); err != nil {
 		fatal("%v", err)
 	}
+
+	// Also dump DWARF for the final linked executable, so it can
+	// be compared against the intermediate objects above.
+	if _, err := os.Stat(exefile); err == nil {
+		if err := d.DumpDwarf(exefile, exefile+".dwarf.txt"); err != nil {
+			warn("dumping dwarf for %s: %v", exefile, err)
+		}
+	}
+
+	// c-archive/c-shared also leave behind a companion header next
+	// to exefile; nothing to do but note that it landed where
+	// expected, since -o already pointed the linker at artdir.
+	if mode == "c-archive" || mode == "c-shared" {
+		hdrfile := exefile[:len(exefile)-len(filepath.Ext(exefile))] + ".h"
+		if _, err := os.Stat(hdrfile); err != nil {
+			warn("expected companion header %s not found: %v", hdrfile, err)
+		} else {
+			verb(1, "captured companion header %s", hdrfile)
+		}
+	}
+
+	// A plugin has no per-object dumps of its own to speak of, so
+	// additionally record its exported symbol table.
+	if mode == "plugin" {
+		if _, err := os.Stat(exefile); err == nil {
+			if err := d.RunOut([]string{"go", "tool", "nm", exefile}, exefile+".nm.txt"); err != nil {
+				warn("go tool nm %s: %v", exefile, err)
+			}
+		}
+	}
+
+	entry.Files = hashArtifacts(artdir)
+	return entry
 }
 
-func copyfile(from string, to string) {
-	input, err := ioutil.ReadFile(from)
+// unpackArchive unpacks the per-package ".a" archive at path into a
+// sibling "<archive>.d" directory using "go tool pack x", then runs
+// the usual object-dump path (objdump -t plus a DWARF dump) over
+// the extracted "_go_.o", any host objects, and whatever else the
+// archive contains. Most symbols disappear into these archives
+// before the link step, so without this the captured artifacts
+// aren't self-describing. Once unpacked, the package path (read via
+// "go tool nm") is used to rename the destination dir so archive
+// dumps land under a name that means something, rather than the
+// arbitrary short names the build driver gives packages on disk.
+func unpackArchive(d *driver.Driver, path string) {
+	destdir := path + ".d"
+	if err := d.Mkdir(destdir); err != nil {
+		fatal("can't create %s: %v", destdir, err)
+	}
+	if err := d.RunIn(destdir, []string{"go", "tool", "pack", "x", path}); err != nil {
+		fatal("error unpacking archive %s: %v", path, err)
+	}
+
+	if pkgpath := readPkgPath(d, path); pkgpath != "" {
+		tag := strings.ReplaceAll(pkgpath, "/", "_")
+		renamed := filepath.Join(filepath.Dir(destdir), tag+".d")
+		if err := os.Rename(destdir, renamed); err == nil {
+			verb(1, "archive %s is package %q, unpacked to %s", path, pkgpath, renamed)
+			destdir = renamed
+		}
+	}
+
+	entries, err := ioutil.ReadDir(destdir)
+	if err != nil {
+		fatal("reading unpacked archive dir %s: %v", destdir, err)
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		p := filepath.Join(destdir, e.Name())
+		if err := d.DumpObject(p, destdir); err != nil {
+			warn("dumping %s: %v", p, err)
+		}
+	}
+}
+
+// pkgnameSym is the symbol the compiler emits per compile unit
+// recording the package path it belongs to, e.g.
+// "go:cuinfo.packagename.example.com/a/b".
+const pkgnameSym = "go:cuinfo.packagename."
+
+// readPkgPath returns the package path for the archive at
+// archivePath, read from the "go:cuinfo.packagename.<pkgpath>"
+// symbol that "go tool nm" reports for it, or "" if it can't be
+// determined (the archive's "__.PKGDEF" export data starts with the
+// same "go object ..." banner used as the Go-object magic elsewhere
+// in this tool, not the package path, so that can't be used here).
+func readPkgPath(d *driver.Driver, archivePath string) string {
+	tmp, err := ioutil.TempFile("", "capture-extlink-nm-*.txt")
 	if err != nil {
-		fatal("copying %s: readfile %v", from, err)
+		return ""
+	}
+	tmpname := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpname)
+
+	if err := d.RunOut([]string{"go", "tool", "nm", archivePath}, tmpname); err != nil {
+		return ""
 	}
-	err = ioutil.WriteFile(to, input, 0644)
+	f, err := os.Open(tmpname)
 	if err != nil {
-		fatal("copying %s: writefile %s: %v", from, to, err)
+		return ""
 	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, pkgnameSym); idx != -1 {
+			return strings.TrimSpace(line[idx+len(pkgnameSym):])
+		}
+	}
+	return ""
 }
 
 func main() {
@@ -241,6 +442,76 @@ func main() {
 		usage("please supply 'go build' or 'go test' command")
 	}
 	verb(1, "build/test command is: %s", strings.Join(args, " "))
-	perform(args)
+
+	artdirRoot := *outdirflag
+	if artdirRoot == "" {
+		artdirRoot = filepath.Join(os.TempDir(), "xxx."+*tagflag)
+	}
+	d, err := driver.New(artdirRoot)
+	if err != nil {
+		fatal("%v", err)
+	}
+	d.SetVerbose(*verbflag)
+
+	allTargets := parseTargets(*targetsflag)
+	if *shardsflag < 1 {
+		usage("-shards must be >= 1")
+	}
+	if *shardflag < 0 || *shardflag >= *shardsflag {
+		usage("-shard must be in [0, shards)")
+	}
+	var targets []target
+	for i, t := range allTargets {
+		if i%*shardsflag == *shardflag {
+			targets = append(targets, t)
+		}
+	}
+	verb(1, "shard %d/%d is processing %d of %d targets",
+		*shardflag, *shardsflag, len(targets), len(allTargets))
+
+	modes := strings.Split(*buildmodesflag, ",")
+
+	par := *jflag
+	if par < 1 {
+		par = 1
+	}
+	sem := make(chan struct{}, par)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var manifest []manifestEntry
+
+	for _, t := range targets {
+		t := t
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			for _, mode := range modes {
+				verb(1, "capturing target %s buildmode %s", t, mode)
+				entry := perform(append([]string{}, args...), d, t, mode)
+				mu.Lock()
+				manifest = append(manifest, entry)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(manifest, func(i, j int) bool {
+		if manifest[i].Target != manifest[j].Target {
+			return manifest[i].Target < manifest[j].Target
+		}
+		return manifest[i].Buildmode < manifest[j].Buildmode
+	})
+	mb, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		fatal("marshaling manifest: %v", err)
+	}
+	manifestPath := filepath.Join(d.Root(), "manifest.json")
+	if err := ioutil.WriteFile(manifestPath, mb, 0644); err != nil {
+		fatal("writing %s: %v", manifestPath, err)
+	}
+	verb(1, "wrote manifest to %s", manifestPath)
 	verb(1, "leaving main")
 }